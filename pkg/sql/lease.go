@@ -0,0 +1,828 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package sql
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/config"
+	"github.com/cockroachdb/cockroach/pkg/gossip"
+	"github.com/cockroachdb/cockroach/pkg/internal/client"
+	"github.com/cockroachdb/cockroach/pkg/keys"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/encoding"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/stop"
+	"github.com/pkg/errors"
+)
+
+// LeaseState holds the state for a table version lease. A lease is granted
+// on a specific version of a table descriptor and is held by a single node
+// for a bounded amount of time; all queries that run against the table
+// within that window are guaranteed to see that exact descriptor version.
+type LeaseState struct {
+	sqlbase.TableDescriptor
+	// The expiration time for the lease, stored as a SQL timestamp so that
+	// it round-trips through the same KV encoding used for table data.
+	expiration parser.DTimestamp
+
+	mu       sync.Mutex
+	refcount int
+	// lastConfirmed is when this lease's descriptor was last confirmed
+	// fresh: at acquisition, and again every time the gossip refresher
+	// checks in and finds no newer version gossiped. AcquireBoundedStaleness
+	// measures staleness from this, not from the (much later) expiration.
+	lastConfirmed time.Time
+}
+
+// Expiration returns the lease's expiration time.
+func (s *LeaseState) Expiration() time.Time {
+	return s.expiration.Time
+}
+
+// expirationToHLC converts the lease's expiration to an hlc.Timestamp for
+// comparison against the KV-level clock.
+func (s *LeaseState) expirationToHLC() hlc.Timestamp {
+	return hlc.Timestamp{WallTime: s.expiration.UnixNano()}
+}
+
+func (s *LeaseState) String() string {
+	return fmt.Sprintf("%d(%q) ver=%d:%d", s.ID, s.Name, s.Version, s.expiration.UnixNano())
+}
+
+func (s *LeaseState) Refcount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.refcount
+}
+
+// leaseSet maintains an ordered (by version) set of LeaseState instances for
+// a single table. It's kept sorted by descriptor version so that
+// findNewest can scan backwards for the newest lease of exactly a
+// requested version.
+type leaseSet struct {
+	data []*LeaseState
+}
+
+func (l *leaseSet) String() string {
+	var buf bytes.Buffer
+	for i, s := range l.data {
+		if i > 0 {
+			buf.WriteString(" ")
+		}
+		fmt.Fprintf(&buf, "%d:%d", s.Version, s.expiration.UnixNano())
+	}
+	return buf.String()
+}
+
+// insert adds a lease to the set, maintaining the invariant that data is
+// sorted by (Version, expiration).
+func (l *leaseSet) insert(s *LeaseState) {
+	i := 0
+	for ; i < len(l.data); i++ {
+		if l.data[i].Version > s.Version {
+			break
+		}
+		if l.data[i].Version == s.Version && l.data[i].expiration.After(s.expiration.Time) {
+			break
+		}
+	}
+	l.data = append(l.data, nil)
+	copy(l.data[i+1:], l.data[i:])
+	l.data[i] = s
+}
+
+func (l *leaseSet) remove(s *LeaseState) {
+	for i, d := range l.data {
+		if d == s {
+			l.data = append(l.data[:i], l.data[i+1:]...)
+			return
+		}
+	}
+}
+
+// findNewest returns the newest lease for the given version, or the overall
+// newest lease if version is 0.
+func (l *leaseSet) findNewest(version sqlbase.DescriptorVersion) *LeaseState {
+	if len(l.data) == 0 {
+		return nil
+	}
+	if version == 0 {
+		return l.data[len(l.data)-1]
+	}
+	for i := len(l.data) - 1; i >= 0; i-- {
+		if l.data[i].Version == version {
+			return l.data[i]
+		}
+	}
+	return nil
+}
+
+// tableState holds the lease state for all versions of a single table that
+// are currently held by this node.
+type tableState struct {
+	id sqlbase.ID
+
+	mu sync.Mutex
+
+	active leaseSet
+	// dropped is set when the table has been dropped; once set, leases
+	// released on this table are also purged from the name cache.
+	dropped bool
+}
+
+// purgeOldLeases releases all leases on this table whose version is older
+// than minVersion, once their refcount has drained to zero; leases that are
+// still referenced are left for their holders' Release to evict. dropped
+// indicates whether the table itself has been dropped, in which case all
+// versions are eligible regardless of minVersion.
+func (t *tableState) purgeOldLeases(
+	ctx context.Context,
+	db *client.DB,
+	dropped bool,
+	minVersion sqlbase.DescriptorVersion,
+	store *LeaseManager,
+) error {
+	t.mu.Lock()
+	var toRelease []*LeaseState
+	for _, s := range t.active.data {
+		if dropped || s.Version < minVersion {
+			s.mu.Lock()
+			drained := s.refcount == 0
+			s.mu.Unlock()
+			if drained {
+				toRelease = append(toRelease, s)
+			}
+		}
+	}
+	t.mu.Unlock()
+
+	for _, s := range toRelease {
+		if err := store.Release(s.TableDescriptor); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tableNameCache maps (parentID, lowercased name) to the newest unexpired
+// lease for that name, letting name resolution avoid a KV round-trip.
+type tableNameCache struct {
+	mu     sync.Mutex
+	tables map[tableNameCacheKey]*LeaseState
+}
+
+type tableNameCacheKey struct {
+	parentID sqlbase.ID
+	name     string
+}
+
+func newTableNameCache() *tableNameCache {
+	return &tableNameCache{tables: make(map[tableNameCacheKey]*LeaseState)}
+}
+
+func (c *tableNameCache) get(parentID sqlbase.ID, name string, clock hlc.Clock) *LeaseState {
+	c.mu.Lock()
+	s, ok := c.tables[tableNameCacheKey{parentID, sqlbase.NormalizeName(name)}]
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.expiration.Time.Before(clock.Now().GoTime()) {
+		return nil
+	}
+	s.refcount++
+	return s
+}
+
+func (c *tableNameCache) insert(s *LeaseState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := tableNameCacheKey{s.ParentID, sqlbase.NormalizeName(s.Name)}
+	if existing, ok := c.tables[key]; !ok || existing.expiration.Before(s.expiration.Time) {
+		c.tables[key] = s
+	}
+}
+
+func (c *tableNameCache) remove(s *LeaseState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := tableNameCacheKey{s.ParentID, sqlbase.NormalizeName(s.Name)}
+	if existing, ok := c.tables[key]; ok && existing == s {
+		delete(c.tables, key)
+	}
+}
+
+// LeaseStoreTestingKnobs allows tests to observe and interfere with the
+// low-level lease acquisition/release path.
+type LeaseStoreTestingKnobs struct {
+	// LeaseReleasedEvent, if set, is invoked every time a lease is released
+	// from the store, successfully or not.
+	LeaseReleasedEvent func(table sqlbase.TableDescriptor, err error)
+}
+
+// ModuleTestingKnobs implements the base.ModuleTestingKnobs interface.
+func (*LeaseStoreTestingKnobs) ModuleTestingKnobs() {}
+
+var _ base.ModuleTestingKnobs = &LeaseStoreTestingKnobs{}
+
+// LeaseStore implements the lower-level KV operations for acquiring and
+// releasing table descriptor leases.
+type LeaseStore struct {
+	db            *client.DB
+	clock         hlc.Clock
+	nodeID        roachpb.NodeID
+	testingKnobs  LeaseStoreTestingKnobs
+	leaseDuration time.Duration
+}
+
+// systemLeaseTablePrefix is the key prefix under which every node's
+// outstanding leases are recorded, one KV row per (tableID, version,
+// expiration, nodeID) tuple — the same shape as system.lease's primary key.
+// Unlike the per-node in-memory tableState, this is the thing other nodes
+// can actually observe, which is what lets WaitForOneVersion answer "has
+// every node in the cluster let go of the old version" instead of just
+// "have I".
+var systemLeaseTablePrefix = keys.MakeTablePrefix(uint32(keys.LeaseTableID))
+
+// leaseTablePrefix returns the key prefix covering every outstanding lease
+// row for tableID, regardless of version.
+func leaseTablePrefix(tableID sqlbase.ID) roachpb.Key {
+	key := append(roachpb.Key(nil), systemLeaseTablePrefix...)
+	return encoding.EncodeUvarintAscending(key, uint64(tableID))
+}
+
+// leaseRowKey returns the system.lease row key for a single lease.
+func leaseRowKey(
+	tableID sqlbase.ID, version sqlbase.DescriptorVersion, expiration hlc.Timestamp, nodeID roachpb.NodeID,
+) roachpb.Key {
+	key := leaseTablePrefix(tableID)
+	key = encoding.EncodeUvarintAscending(key, uint64(version))
+	key = encoding.EncodeVarintAscending(key, expiration.WallTime)
+	return encoding.EncodeUvarintAscending(key, uint64(nodeID))
+}
+
+// acquire acquires a new lease on the named table at the latest version,
+// inserting a row into system.lease and returning the descriptor and the
+// lease's expiration.
+func (s LeaseStore) acquire(
+	ctx context.Context, txn *client.Txn, minVersion sqlbase.DescriptorVersion, tableID sqlbase.ID,
+) (*LeaseState, error) {
+	var lease *LeaseState
+	table, err := sqlbase.GetTableDescFromID(ctx, txn, tableID)
+	if err != nil {
+		return nil, err
+	}
+	if minVersion != 0 && table.Version < minVersion {
+		return nil, errors.Errorf("table %d: version %d does not satisfy minimum version %d",
+			tableID, table.Version, minVersion)
+	}
+	now := s.clock.Now().GoTime()
+	lease = &LeaseState{TableDescriptor: *table, refcount: 1, lastConfirmed: now}
+	lease.expiration.Time = now.Add(s.leaseDuration).Add(time.Duration(jitteredLeaseDuration()))
+	key := leaseRowKey(table.ID, table.Version, lease.expirationToHLC(), s.nodeID)
+	if err := txn.Put(ctx, key, nil); err != nil {
+		return nil, err
+	}
+	return lease, nil
+}
+
+// release deletes the lease's row from system.lease so that other nodes'
+// WaitForOneVersion calls stop counting it, notifying LeaseReleasedEvent
+// regardless of outcome.
+func (s LeaseStore) release(ctx context.Context, lease *LeaseState) error {
+	key := leaseRowKey(lease.ID, lease.Version, lease.expirationToHLC(), s.nodeID)
+	err := s.db.Txn(ctx, func(ctx context.Context, txn *client.Txn) error {
+		return txn.Del(ctx, key)
+	})
+	if s.testingKnobs.LeaseReleasedEvent != nil {
+		s.testingKnobs.LeaseReleasedEvent(lease.TableDescriptor, err)
+	}
+	return err
+}
+
+// countLeases returns the number of outstanding leases recorded in
+// system.lease, cluster-wide, on tableID at a version strictly older than
+// minVersion. It's the cluster-wide counterpart to inspecting a node's own
+// tableState, and is what lets WaitForOneVersion safely gate GC of a
+// dropped index's data.
+func (s LeaseStore) countLeases(
+	ctx context.Context, tableID sqlbase.ID, minVersion sqlbase.DescriptorVersion,
+) (int, error) {
+	prefix := leaseTablePrefix(tableID)
+	count := 0
+	err := s.db.Txn(ctx, func(ctx context.Context, txn *client.Txn) error {
+		count = 0
+		rows, err := txn.Scan(ctx, prefix, prefix.PrefixEnd(), 0)
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			_, version, err := encoding.DecodeUvarintAscending(row.Key[len(prefix):])
+			if err != nil {
+				return err
+			}
+			if sqlbase.DescriptorVersion(version) < minVersion {
+				count++
+			}
+		}
+		return nil
+	})
+	return count, err
+}
+
+// jitteredLeaseDuration returns the extra time added on top of
+// leaseDuration for each newly acquired lease. It always returns zero: no
+// jitter is applied, so leases acquired at around the same time also
+// expire at around the same time.
+func jitteredLeaseDuration() time.Duration {
+	return time.Duration(0)
+}
+
+// LeaseManagerTestingKnobs groups the testing knobs controllable through
+// base.TestingKnobs.SQLLeaseManager.
+type LeaseManagerTestingKnobs struct {
+	LeaseStoreTestingKnobs
+
+	// GossipUpdateEvent, if set, is invoked synchronously every time the
+	// lease manager processes a gossip update of the SystemConfig.
+	GossipUpdateEvent func(cfg config.SystemConfig)
+
+	// GossipRefreshTriggered, if set, is invoked after the refresher has
+	// decided a table's descriptor changed and is about to proactively
+	// re-acquire its lease.
+	GossipRefreshTriggered func(tableID sqlbase.ID)
+
+	// RefreshSkipped, if set, is invoked for every table the refresher
+	// considered but decided not to refresh, because its gossiped
+	// ModificationTime hadn't advanced.
+	RefreshSkipped func(tableID sqlbase.ID)
+}
+
+// ModuleTestingKnobs implements the base.ModuleTestingKnobs interface.
+func (*LeaseManagerTestingKnobs) ModuleTestingKnobs() {}
+
+var _ base.ModuleTestingKnobs = &LeaseManagerTestingKnobs{}
+
+// LeaseManager manages acquiring and releasing per-table descriptor leases.
+// It is the sole source of truth within a node for which version(s) of a
+// table descriptor are currently safe to read and use for query planning.
+type LeaseManager struct {
+	LeaseStore
+	mu sync.Mutex
+	// tables is keyed by table ID, and holds onto one tableState per table
+	// that this node currently holds (or has held) a lease on.
+	tables map[sqlbase.ID]*tableState
+
+	tableNames *tableNameCache
+
+	testingKnobs LeaseManagerTestingKnobs
+
+	gossip  *gossip.Gossip
+	stopper *stop.Stopper
+}
+
+// NewLeaseManager constructs a LeaseManager. It does not watch gossip by
+// itself; RefreshLeases starts the worker that handles SystemConfig
+// updates. nodeID identifies this node's leases in
+// system.lease so that other nodes can tell them apart from their own.
+func NewLeaseManager(
+	nodeID roachpb.NodeID,
+	db *client.DB,
+	clock hlc.Clock,
+	testingKnobs LeaseManagerTestingKnobs,
+	stopper *stop.Stopper,
+	leaseDuration time.Duration,
+) *LeaseManager {
+	lm := &LeaseManager{
+		LeaseStore: LeaseStore{
+			db:            db,
+			clock:         clock,
+			nodeID:        nodeID,
+			testingKnobs:  testingKnobs.LeaseStoreTestingKnobs,
+			leaseDuration: leaseDuration,
+		},
+		tables:       make(map[sqlbase.ID]*tableState),
+		tableNames:   newTableNameCache(),
+		testingKnobs: testingKnobs,
+		stopper:      stopper,
+	}
+	return lm
+}
+
+// findTableState returns the tableState for id, creating an empty one if
+// create is true and none exists yet.
+func (m *LeaseManager) findTableState(id sqlbase.ID, create bool) *tableState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t := m.tables[id]
+	if t == nil && create {
+		t = &tableState{id: id}
+		m.tables[id] = t
+	}
+	return t
+}
+
+// acquireFreshestFromStore always checks the store for the newest version
+// of the table descriptor rather than trusting a cached lease that might
+// already be stale, but it still reuses (and refcounts) an already-cached,
+// unexpired lease for that exact version instead of minting a duplicate
+// LeaseState — otherwise repeated Acquire/Release cycles against a version
+// that never changes would pile up zero-refcount entries in ts.active
+// forever, since Release only ever looks up, and so only ever evicts, the
+// newest entry for a given version.
+func (m *LeaseManager) acquireFreshestFromStore(
+	ctx context.Context, txn *client.Txn, tableID sqlbase.ID,
+) (sqlbase.TableDescriptor, hlc.Timestamp, error) {
+	table, err := sqlbase.GetTableDescFromID(ctx, txn, tableID)
+	if err != nil {
+		return sqlbase.TableDescriptor{}, hlc.Timestamp{}, err
+	}
+
+	ts := m.findTableState(tableID, true)
+	ts.mu.Lock()
+	if s := ts.active.findNewest(table.Version); s != nil && s.expiration.Time.After(m.clock.Now().GoTime()) {
+		s.mu.Lock()
+		s.refcount++
+		s.mu.Unlock()
+		ts.mu.Unlock()
+		return s.TableDescriptor, s.expirationToHLC(), nil
+	}
+	ts.mu.Unlock()
+
+	lease, err := m.LeaseStore.acquire(ctx, txn, 0, tableID)
+	if err != nil {
+		return sqlbase.TableDescriptor{}, hlc.Timestamp{}, err
+	}
+	ts.mu.Lock()
+	ts.active.insert(lease)
+	ts.mu.Unlock()
+	m.tableNames.insert(lease)
+	return lease.TableDescriptor, lease.expirationToHLC(), nil
+}
+
+// Acquire returns the most recent cached lease for tableID if one is live,
+// otherwise it acquires a new one from the store.
+func (m *LeaseManager) Acquire(
+	ctx context.Context, txn *client.Txn, tableID sqlbase.ID, version sqlbase.DescriptorVersion,
+) (*LeaseState, error) {
+	ts := m.findTableState(tableID, true)
+	ts.mu.Lock()
+	if s := ts.active.findNewest(version); s != nil && s.expiration.Time.After(m.clock.Now().GoTime()) {
+		s.mu.Lock()
+		s.refcount++
+		s.mu.Unlock()
+		ts.mu.Unlock()
+		return s, nil
+	}
+	ts.mu.Unlock()
+
+	lease, err := m.LeaseStore.acquire(ctx, txn, version, tableID)
+	if err != nil {
+		return nil, err
+	}
+	ts.mu.Lock()
+	ts.active.insert(lease)
+	ts.mu.Unlock()
+	m.tableNames.insert(lease)
+	return lease, nil
+}
+
+// AcquireByName resolves parentID/name to a table ID via the name cache
+// (falling back to the store on a miss) and acquires a lease on it.
+func (m *LeaseManager) AcquireByName(
+	ctx context.Context, txn *client.Txn, parentID sqlbase.ID, name string,
+) (sqlbase.TableDescriptor, hlc.Timestamp, error) {
+	if s := m.tableNames.get(parentID, name, m.clock); s != nil {
+		return s.TableDescriptor, s.expirationToHLC(), nil
+	}
+	tableID, err := sqlbase.ResolveTableID(ctx, txn, parentID, name)
+	if err != nil {
+		return sqlbase.TableDescriptor{}, hlc.Timestamp{}, err
+	}
+	lease, err := m.Acquire(ctx, txn, tableID, 0)
+	if err != nil {
+		return sqlbase.TableDescriptor{}, hlc.Timestamp{}, err
+	}
+	return lease.TableDescriptor, lease.expirationToHLC(), nil
+}
+
+// Release decrements the refcount on the lease held for table.ID at
+// table.Version, releasing it from the store once the refcount reaches zero
+// and the lease is no longer worth keeping around: it's for a dropped
+// table, it's expired, or a newer version has superseded it. A lease that
+// drains to refcount zero while still the newest live version is left in
+// ts.active so a subsequent Acquire can find and reuse it without a round
+// trip to the store, per acquireFreshestFromStore's dedup.
+//
+// purgeOldLeases calls this on stale-version entries whose refcount has
+// already drained to zero, so refcount is clamped at zero rather than allowed to go negative, which would
+// otherwise make shouldRemove permanently false for that entry.
+func (m *LeaseManager) Release(table sqlbase.TableDescriptor) error {
+	ts := m.findTableState(table.ID, false)
+	if ts == nil {
+		return errors.Errorf("table %d not found", table.ID)
+	}
+	ts.mu.Lock()
+	s := ts.active.findNewest(table.Version)
+	if s == nil {
+		ts.mu.Unlock()
+		return errors.Errorf("table %d version %d not found", table.ID, table.Version)
+	}
+	s.mu.Lock()
+	if s.refcount > 0 {
+		s.refcount--
+	}
+	refcount := s.refcount
+	s.mu.Unlock()
+	superseded := ts.active.findNewest(0) != s
+	shouldRemove := refcount == 0 &&
+		(ts.dropped || superseded || s.expiration.Time.Before(m.clock.Now().GoTime()))
+	if shouldRemove {
+		ts.active.remove(s)
+	}
+	ts.mu.Unlock()
+
+	if !shouldRemove {
+		return nil
+	}
+	if ts.dropped {
+		m.tableNames.remove(s)
+	}
+	return m.LeaseStore.release(context.TODO(), s)
+}
+
+// Publish applies update to the latest version of the table descriptor and
+// writes the new version back, bumping TableDescriptor.Version by one. It
+// is the single choke point through which schema-modifying statements
+// persist their changes, which lets it double as the place where lease
+// invalidation for the old version is kicked off.
+func (m *LeaseManager) Publish(
+	ctx context.Context,
+	tableID sqlbase.ID,
+	update func(*sqlbase.TableDescriptor) error,
+	logEvent func(txn *client.Txn) error,
+) (*sqlbase.TableDescriptor, error) {
+	var table *sqlbase.TableDescriptor
+	var before sqlbase.TableDescriptor
+	err := m.db.Txn(ctx, func(ctx context.Context, txn *client.Txn) error {
+		var err error
+		table, err = sqlbase.GetTableDescFromID(ctx, txn, tableID)
+		if err != nil {
+			return err
+		}
+		before = *table
+		oldVersion := table.Version
+		if err := update(table); err != nil {
+			return err
+		}
+		table.Version++
+		if err := sqlbase.WriteTableDesc(ctx, txn, table); err != nil {
+			return err
+		}
+		if logEvent != nil {
+			if err := logEvent(txn); err != nil {
+				return err
+			}
+		}
+		log.Eventf(ctx, "published table %d: version %d -> %d", tableID, oldVersion, table.Version)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Purge leases held on versions older than the one we just published;
+	// WaitForOneVersion relies on this happening so that it can tell when
+	// every node has moved off the old descriptor.
+	if ts := m.findTableState(tableID, false); ts != nil {
+		if err := ts.purgeOldLeases(ctx, m.db, false, table.Version, m); err != nil {
+			return nil, err
+		}
+	}
+	m.scheduleIndexGCForNewMutations(&before, table)
+	return table, nil
+}
+
+// ExpireLeases marks every lease held by this node as expired as of clock's
+// current time, for use in tests that need to force cache misses.
+func (m *LeaseManager) ExpireLeases(clock hlc.Clock) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	past := parser.DTimestamp{Time: clock.Now().GoTime().Add(-time.Second)}
+	for _, ts := range m.tables {
+		ts.mu.Lock()
+		for _, s := range ts.active.data {
+			s.mu.Lock()
+			s.expiration = past
+			s.mu.Unlock()
+		}
+		ts.mu.Unlock()
+	}
+}
+
+// RefreshLeases subscribes to gossip updates of the SystemConfig and is run
+// as a stopper task for the lifetime of the LeaseManager. For every table
+// this node currently holds a lease on, it diffs the gossiped descriptor's
+// ModificationTime against the newest cached lease and, if the table
+// changed, proactively acquires a lease on the new version and purges the
+// old one — instead of waiting for the next query on that table to notice
+// the version is stale.
+func (m *LeaseManager) RefreshLeases(s *stop.Stopper, db *client.DB, g *gossip.Gossip) {
+	s.RunWorker(func() {
+		gossipUpdateC := g.RegisterSystemConfigChannel()
+		for {
+			select {
+			case <-gossipUpdateC:
+				cfg, _ := g.GetSystemConfig()
+				if m.testingKnobs.GossipUpdateEvent != nil {
+					m.testingKnobs.GossipUpdateEvent(cfg)
+				}
+				m.refreshFromSystemConfig(context.TODO(), db, cfg)
+			case <-s.ShouldStop():
+				return
+			}
+		}
+	})
+}
+
+// refreshFromSystemConfig is the synchronous body of the gossip refresher,
+// split out so it can be driven directly from tests.
+func (m *LeaseManager) refreshFromSystemConfig(ctx context.Context, db *client.DB, cfg config.SystemConfig) {
+	m.mu.Lock()
+	tableIDs := make([]sqlbase.ID, 0, len(m.tables))
+	for tableID := range m.tables {
+		tableIDs = append(tableIDs, tableID)
+	}
+	m.mu.Unlock()
+
+	for _, tableID := range tableIDs {
+		ts := m.findTableState(tableID, false)
+		if ts == nil {
+			continue
+		}
+		ts.mu.Lock()
+		newest := ts.active.findNewest(0)
+		ts.mu.Unlock()
+		if newest == nil {
+			continue
+		}
+
+		desc, ok := cfg.GetValue(sqlbase.MakeDescMetadataKey(tableID))
+		if !ok {
+			continue
+		}
+		var gossiped sqlbase.TableDescriptor
+		if err := gossiped.Unmarshal(desc); err != nil {
+			log.Warningf(ctx, "failed to unmarshal gossiped descriptor for table %d: %s", tableID, err)
+			continue
+		}
+		if !newest.ModificationTime.Less(gossiped.ModificationTime) {
+			// The table hasn't changed, but gossip just confirmed that, so
+			// the cached lease is fresh as of now for AcquireBoundedStaleness
+			// purposes even though it's not being re-acquired.
+			newest.mu.Lock()
+			newest.lastConfirmed = m.clock.Now().GoTime()
+			newest.mu.Unlock()
+			if m.testingKnobs.RefreshSkipped != nil {
+				m.testingKnobs.RefreshSkipped(tableID)
+			}
+			continue
+		}
+
+		if m.testingKnobs.GossipRefreshTriggered != nil {
+			m.testingKnobs.GossipRefreshTriggered(tableID)
+		}
+		var fresh sqlbase.TableDescriptor
+		err := db.Txn(ctx, func(ctx context.Context, txn *client.Txn) error {
+			var err error
+			fresh, _, err = m.acquireFreshestFromStore(ctx, txn, tableID)
+			return err
+		})
+		if err != nil {
+			log.Warningf(ctx, "failed to proactively refresh lease on table %d: %s", tableID, err)
+			continue
+		}
+		// Drop the refresher's own reference; the fresh lease stays cached as
+		// the newest version for the next Acquire to reuse.
+		if err := m.Release(fresh); err != nil {
+			log.Warningf(ctx, "failed to release refreshed lease on table %d: %s", tableID, err)
+		}
+		if err := ts.purgeOldLeases(ctx, db, false, gossiped.Version, m); err != nil {
+			log.Warningf(ctx, "failed to purge old leases on table %d after refresh: %s", tableID, err)
+		}
+	}
+}
+
+// AcquireBoundedStaleness returns the newest cached lease for tableID that
+// was confirmed fresh (at acquisition, or by the gossip refresher since)
+// within maxStaleness of hlc.Now(), without ever going to the store. It's
+// meant for catalog lookups that can tolerate reading a slightly stale
+// table descriptor in exchange for avoiding a KV round-trip entirely.
+//
+// Note that this measures staleness from when the lease was last
+// confirmed current, not from its (far later) expiration: an unexpired
+// lease can still be well behind maxStaleness if the refresher hasn't
+// checked in recently, and checking the expiration alone would never
+// reject it until just before it lapsed.
+func (m *LeaseManager) AcquireBoundedStaleness(
+	ctx context.Context, tableID sqlbase.ID, maxStaleness time.Duration,
+) (*LeaseState, error) {
+	ts := m.findTableState(tableID, false)
+	if ts == nil {
+		return nil, errors.Errorf("table %d: no cached lease available", tableID)
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	s := ts.active.findNewest(0)
+	if s == nil {
+		return nil, errors.Errorf("table %d: no cached lease available", tableID)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	staleness := m.clock.Now().GoTime().Sub(s.lastConfirmed)
+	if staleness > maxStaleness {
+		return nil, errors.Errorf(
+			"table %d: cached lease is %s stale, exceeding bound of %s", tableID, staleness, maxStaleness)
+	}
+	s.refcount++
+	return s, nil
+}
+
+// LeaseRemovalTracker helps tests wait deterministically for a specific
+// lease to be released from the store, instead of polling.
+type LeaseRemovalTracker struct {
+	mu       sync.Mutex
+	tracking map[leaseRemovalTrackerKey]*leaseRemovalTracker
+}
+
+type leaseRemovalTrackerKey struct {
+	tableID sqlbase.ID
+	version sqlbase.DescriptorVersion
+}
+
+type leaseRemovalTracker struct {
+	removed chan error
+}
+
+// WaitForRemoval blocks until the tracked lease has been released.
+func (t *leaseRemovalTracker) WaitForRemoval() error {
+	return <-t.removed
+}
+
+// NewLeaseRemovalTracker creates a LeaseRemovalTracker. Use its
+// LeaseRemovedNotification method as a LeaseStoreTestingKnobs.LeaseReleasedEvent.
+func NewLeaseRemovalTracker() *LeaseRemovalTracker {
+	return &LeaseRemovalTracker{
+		tracking: make(map[leaseRemovalTrackerKey]*leaseRemovalTracker),
+	}
+}
+
+// TrackRemoval registers interest in being notified when table's lease is
+// released, returning a tracker whose WaitForRemoval will block until then.
+func (t *LeaseRemovalTracker) TrackRemoval(table sqlbase.TableDescriptor) *leaseRemovalTracker {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := leaseRemovalTrackerKey{table.ID, table.Version}
+	tracker, ok := t.tracking[key]
+	if !ok {
+		tracker = &leaseRemovalTracker{removed: make(chan error, 1)}
+		t.tracking[key] = tracker
+	}
+	return tracker
+}
+
+// LeaseRemovedNotification is a LeaseStoreTestingKnobs.LeaseReleasedEvent
+// implementation that fans the event out to any tracker registered via
+// TrackRemoval.
+func (t *LeaseRemovalTracker) LeaseRemovedNotification(table sqlbase.TableDescriptor, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := leaseRemovalTrackerKey{table.ID, table.Version}
+	if tracker, ok := t.tracking[key]; ok {
+		tracker.removed <- err
+		delete(t.tracking, key)
+	}
+}
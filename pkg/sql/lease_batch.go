@@ -0,0 +1,117 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package sql
+
+import (
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/internal/client"
+	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/pkg/errors"
+)
+
+// batchNameMiss records a table name that missed the name cache while
+// AcquireManyByName was coalescing its lookups, along with where its result
+// belongs in the caller's slice.
+type batchNameMiss struct {
+	resultIndex int
+	parentID    sqlbase.ID
+	name        string
+}
+
+// AcquireManyByName resolves and leases a batch of tables, coalescing
+// name-cache hits and looking up the table IDs of every name-cache miss in
+// a single client.Batch. The database ID of each name is resolved with its
+// own ResolveDatabaseID call, and each miss is leased with its own Acquire
+// call, so those are not batched. Lookup is case-insensitive, matching
+// AcquireByName. On partial failure, every lease already acquired in this
+// call is released before the error is returned, so a failed batch never
+// leaks leases the way the lock-inversion bug in
+// TestReleaseAcquireByNameDeadlock relied on a stray Release to trigger.
+func (m *LeaseManager) AcquireManyByName(
+	ctx context.Context, txn *client.Txn, names []parser.TableName,
+) ([]sqlbase.TableDescriptor, []hlc.Timestamp, error) {
+	tables := make([]sqlbase.TableDescriptor, len(names))
+	expirations := make([]hlc.Timestamp, len(names))
+
+	var misses []batchNameMiss
+	for i, name := range names {
+		parentID, err := sqlbase.ResolveDatabaseID(ctx, txn, string(name.DatabaseName))
+		if err != nil {
+			m.releaseAll(tables[:i])
+			return nil, nil, err
+		}
+		if s := m.tableNames.get(parentID, string(name.TableName), m.clock); s != nil {
+			tables[i] = s.TableDescriptor
+			expirations[i] = s.expirationToHLC()
+			continue
+		}
+		misses = append(misses, batchNameMiss{i, parentID, string(name.TableName)})
+	}
+	if len(misses) == 0 {
+		return tables, expirations, nil
+	}
+
+	b := txn.NewBatch()
+	for _, ms := range misses {
+		b.Get(sqlbase.MakeNameMetadataKey(ms.parentID, sqlbase.NormalizeName(ms.name)))
+	}
+	if err := txn.Run(b); err != nil {
+		m.releaseAll(tables)
+		return nil, nil, err
+	}
+
+	for i, ms := range misses {
+		// A missing name is a normal occurrence (a typo'd table reference in
+		// the FROM clause), and must surface the same clean "does not exist"
+		// error AcquireByName's sqlbase.ResolveTableID path would — not fall
+		// through to decoding a nil/garbage value as a table ID.
+		row := b.Results[i].Rows
+		if len(row) == 0 || row[0].Value == nil {
+			m.releaseAll(tables)
+			return nil, nil, errors.Errorf("table %q does not exist", ms.name)
+		}
+		tableID, err := sqlbase.UnmarshalDescID(row[0].Value)
+		if err != nil {
+			m.releaseAll(tables)
+			return nil, nil, err
+		}
+		lease, err := m.Acquire(ctx, txn, tableID, 0)
+		if err != nil {
+			m.releaseAll(tables)
+			return nil, nil, err
+		}
+		tables[ms.resultIndex] = lease.TableDescriptor
+		expirations[ms.resultIndex] = lease.expirationToHLC()
+	}
+	return tables, expirations, nil
+}
+
+// releaseAll releases every non-zero lease in tables, logging (rather than
+// returning) failures so that unwinding a partially-acquired batch can't
+// itself be short-circuited by the first release error.
+func (m *LeaseManager) releaseAll(tables []sqlbase.TableDescriptor) {
+	for _, t := range tables {
+		if t.ID == 0 {
+			continue
+		}
+		if err := m.Release(t); err != nil {
+			log.Warningf(context.TODO(), "failed to release lease on table %d while unwinding batch: %s", t.ID, err)
+		}
+	}
+}
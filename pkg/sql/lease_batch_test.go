@@ -0,0 +1,82 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package sql
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/internal/client"
+	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/testutils/serverutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+// TestAcquireManyByName checks that a batch of names is resolved and
+// leased case-insensitively in one call, and that a batch containing a
+// reference to a nonexistent table fails with an error.
+func TestAcquireManyByName(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	s, db, kvDB := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(context.TODO())
+	leaseManager := s.LeaseManager().(*LeaseManager)
+
+	if _, err := db.Exec(`
+CREATE DATABASE t;
+CREATE TABLE t.a (k CHAR PRIMARY KEY);
+CREATE TABLE t.b (k CHAR PRIMARY KEY);
+`); err != nil {
+		t.Fatal(err)
+	}
+
+	names := []parser.TableName{
+		{DatabaseName: "t", TableName: "A"},
+		{DatabaseName: "t", TableName: "b"},
+	}
+	var tables []sqlbase.TableDescriptor
+	if err := kvDB.Txn(context.TODO(), func(ctx context.Context, txn *client.Txn) error {
+		var err error
+		tables, _, err = leaseManager.AcquireManyByName(ctx, txn, names)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(tables) != 2 || tables[0].Name != "a" || tables[1].Name != "b" {
+		t.Fatalf("unexpected tables: %+v", tables)
+	}
+	for _, table := range tables {
+		if err := leaseManager.Release(table); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A reference to a table that doesn't exist should release whatever was
+	// already acquired in the batch and surface a clean error, not decode
+	// garbage into a table ID.
+	names = []parser.TableName{
+		{DatabaseName: "t", TableName: "a"},
+		{DatabaseName: "t", TableName: "nonexistent"},
+	}
+	err := kvDB.Txn(context.TODO(), func(ctx context.Context, txn *client.Txn) error {
+		_, _, err := leaseManager.AcquireManyByName(ctx, txn, names)
+		return err
+	})
+	if err == nil {
+		t.Fatal("expected an error acquiring a batch with a nonexistent table")
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package sql
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/internal/client"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/retry"
+)
+
+// waitForOneVersionRetryOptions bounds how aggressively WaitForOneVersion
+// polls for outstanding leases on old descriptor versions to drain.
+var waitForOneVersionRetryOptions = retry.Options{
+	InitialBackoff: 20 * time.Millisecond,
+	MaxBackoff:     3 * time.Second,
+	Multiplier:     2,
+}
+
+// WaitForOneVersion blocks until every lease held anywhere in the cluster
+// on tableID, other than the one for the current version itself, has been
+// released, i.e. until at most one version of the table descriptor is
+// leased cluster-wide. It's used as a barrier before an old table version's
+// data can safely be reclaimed: once it returns, no query on any node can
+// still be running against the version that's being torn down. This relies
+// on leases being recorded in system.lease (see LeaseStore.countLeases) —
+// a node's own in-memory tableState only knows what that one node holds.
+func (m *LeaseManager) WaitForOneVersion(
+	ctx context.Context, tableID sqlbase.ID,
+) (sqlbase.DescriptorVersion, error) {
+	for r := retry.StartWithCtx(ctx, waitForOneVersionRetryOptions); r.Next(); {
+		var table *sqlbase.TableDescriptor
+		err := m.db.Txn(ctx, func(ctx context.Context, txn *client.Txn) error {
+			var err error
+			table, err = sqlbase.GetTableDescFromID(ctx, txn, tableID)
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+
+		count, err := m.LeaseStore.countLeases(ctx, tableID, table.Version)
+		if err != nil {
+			return 0, err
+		}
+		if count == 0 {
+			return table.Version, nil
+		}
+	}
+	return 0, ctx.Err()
+}
+
+// gcIndexData is the background job scheduled by Publish whenever it
+// commits a descriptor version moving an index from DescriptorActive into
+// a DROP mutation. It waits for every node to release its leases on the
+// pre-drop descriptor version, then deletes the index's data in one
+// ranged delete.
+func (m *LeaseManager) gcIndexData(tableID sqlbase.ID, indexID sqlbase.IndexID) {
+	m.stopper.RunWorker(func() {
+		ctx := context.TODO()
+		if _, err := m.WaitForOneVersion(ctx, tableID); err != nil {
+			log.Warningf(ctx, "giving up on GC of index %d on table %d: %s", indexID, tableID, err)
+			return
+		}
+		prefix := roachpb.Key(sqlbase.MakeIndexKeyPrefix(tableID, indexID))
+		if err := m.db.DelRange(ctx, prefix, prefix.PrefixEnd()); err != nil {
+			log.Warningf(ctx, "failed to GC index %d on table %d: %s", indexID, tableID, err)
+		}
+	})
+}
+
+// scheduleIndexGCForNewMutations compares the descriptor before and after a
+// Publish-driven update, scheduling gcIndexData for every mutation the
+// update newly added that moves an index from DescriptorActive (in the
+// pre-update descriptor) into a DROP mutation. Consulting before's
+// FindIndexByName, rather than trusting the mutation alone, is what
+// excludes indexes that never had any data to begin with — e.g. one added
+// and dropped again before its ADD mutation ever finished backfilling.
+func (m *LeaseManager) scheduleIndexGCForNewMutations(before, after *sqlbase.TableDescriptor) {
+	if len(after.Mutations) <= len(before.Mutations) {
+		return
+	}
+	for _, mut := range after.Mutations[len(before.Mutations):] {
+		idx := mut.GetIndex()
+		if idx == nil || mut.Direction != sqlbase.DescriptorMutation_DROP {
+			continue
+		}
+		if _, status, err := before.FindIndexByName(idx.Name); err != nil || status != sqlbase.DescriptorActive {
+			continue
+		}
+		m.gcIndexData(after.ID, idx.ID)
+	}
+}
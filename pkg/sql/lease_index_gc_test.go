@@ -0,0 +1,80 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package sql
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/internal/client"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/testutils/serverutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+// TestWaitForOneVersionAfterIndexDrop checks that WaitForOneVersion blocks
+// while this node still holds a lease on the pre-drop descriptor version,
+// and returns only once that lease (the last one
+// cluster-wide, since this test only runs one node) has been released —
+// the barrier gcIndexData relies on before it's safe to delete a dropped
+// index's data.
+func TestWaitForOneVersionAfterIndexDrop(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	s, db, kvDB := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(context.TODO())
+	leaseManager := s.LeaseManager().(*LeaseManager)
+
+	if _, err := db.Exec(`
+CREATE DATABASE t;
+CREATE TABLE t.test (k CHAR PRIMARY KEY, v CHAR, INDEX i (v));
+`); err != nil {
+		t.Fatal(err)
+	}
+	tableDesc := sqlbase.GetTableDescriptor(kvDB, "t", "test")
+
+	var held sqlbase.TableDescriptor
+	if err := kvDB.Txn(context.TODO(), func(ctx context.Context, txn *client.Txn) error {
+		var err error
+		held, _, err = leaseManager.AcquireByName(ctx, txn, tableDesc.ParentID, "test")
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Exec(`DROP INDEX t.test@i`); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		if _, err := leaseManager.WaitForOneVersion(context.TODO(), tableDesc.ID); err != nil {
+			t.Error(err)
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("WaitForOneVersion returned before the pre-drop lease was released")
+	default:
+	}
+
+	if err := leaseManager.Release(held); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+}
@@ -0,0 +1,159 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package sql
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/internal/client"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/testutils/serverutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+// TestGossipRefreshTriggered checks that the gossip-driven refresher
+// notices a table's descriptor changed and proactively re-acquires its
+// lease, and that it reports a skip (rather than a refresh) when nothing
+// changed.
+func TestGossipRefreshTriggered(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	refreshed := make(chan sqlbase.ID, 1)
+	skipped := make(chan sqlbase.ID, 1)
+	serverParams := base.TestServerArgs{
+		Knobs: base.TestingKnobs{
+			SQLLeaseManager: &LeaseManagerTestingKnobs{
+				GossipRefreshTriggered: func(tableID sqlbase.ID) {
+					refreshed <- tableID
+				},
+				RefreshSkipped: func(tableID sqlbase.ID) {
+					skipped <- tableID
+				},
+			},
+		},
+	}
+	s, db, kvDB := serverutils.StartServer(t, serverParams)
+	defer s.Stopper().Stop(context.TODO())
+	leaseManager := s.LeaseManager().(*LeaseManager)
+
+	if _, err := db.Exec(`
+CREATE DATABASE t;
+CREATE TABLE t.test (k CHAR PRIMARY KEY, v CHAR);
+`); err != nil {
+		t.Fatal(err)
+	}
+	tableDesc := sqlbase.GetTableDescriptor(kvDB, "t", "test")
+
+	// Populate the cache with an initial lease so the refresher has
+	// something to diff the next gossip update against.
+	if err := kvDB.Txn(context.TODO(), func(ctx context.Context, txn *client.Txn) error {
+		_, err := leaseManager.Acquire(ctx, txn, tableDesc.ID, 0)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Exec(`ALTER TABLE t.test ADD COLUMN w CHAR`); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case tableID := <-refreshed:
+		if tableID != tableDesc.ID {
+			t.Fatalf("refreshed wrong table: %d", tableID)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for gossip-triggered refresh")
+	}
+
+	select {
+	case tableID := <-skipped:
+		if tableID != tableDesc.ID {
+			t.Fatalf("skipped wrong table: %d", tableID)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for a skipped refresh once the table stopped changing")
+	}
+}
+
+// TestRefreshHeldLeaseSurvivesPurge checks that refreshFromSystemConfig's
+// purgeOldLeases call, triggered after a proactive re-acquire, doesn't
+// steal a still-held lease's refcount out from under its holder: the
+// superseded lease must stick around until the holder actually releases
+// it, and only then get purged.
+func TestRefreshHeldLeaseSurvivesPurge(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	refreshed := make(chan sqlbase.ID, 1)
+	serverParams := base.TestServerArgs{
+		Knobs: base.TestingKnobs{
+			SQLLeaseManager: &LeaseManagerTestingKnobs{
+				GossipRefreshTriggered: func(tableID sqlbase.ID) {
+					refreshed <- tableID
+				},
+			},
+		},
+	}
+	s, db, kvDB := serverutils.StartServer(t, serverParams)
+	defer s.Stopper().Stop(context.TODO())
+	leaseManager := s.LeaseManager().(*LeaseManager)
+
+	if _, err := db.Exec(`
+CREATE DATABASE t;
+CREATE TABLE t.test (k CHAR PRIMARY KEY, v CHAR);
+`); err != nil {
+		t.Fatal(err)
+	}
+	tableDesc := sqlbase.GetTableDescriptor(kvDB, "t", "test")
+
+	var held *LeaseState
+	if err := kvDB.Txn(context.TODO(), func(ctx context.Context, txn *client.Txn) error {
+		var err error
+		held, err = leaseManager.Acquire(ctx, txn, tableDesc.ID, 0)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Exec(`ALTER TABLE t.test ADD COLUMN w CHAR`); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case tableID := <-refreshed:
+		if tableID != tableDesc.ID {
+			t.Fatalf("refreshed wrong table: %d", tableID)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for gossip-triggered refresh")
+	}
+
+	// The refresher's purgeOldLeases call must not have stolen the held
+	// lease's refcount: both the pre-ALTER lease and the freshly refreshed
+	// one should still be present.
+	ts := leaseManager.findTableState(tableDesc.ID, false)
+	if numLeases := getNumLeases(ts); numLeases != 2 {
+		t.Fatalf("found %d leases instead of 2", numLeases)
+	}
+
+	if err := leaseManager.Release(held.TableDescriptor); err != nil {
+		t.Fatal(err)
+	}
+	if numLeases := getNumLeases(ts); numLeases != 1 {
+		t.Fatalf("found %d leases instead of 1 after releasing the held lease", numLeases)
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package sql
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/internal/client"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/pkg/errors"
+)
+
+// schemaChangeLeaseDuration is how long a schema changer's lease on a table
+// descriptor is valid for before it must be extended.
+const schemaChangeLeaseDuration = 5 * time.Minute
+
+// errExistingSchemaChangeLease is returned by AcquireLease when another node
+// already holds an unexpired lease on the table.
+var errExistingSchemaChangeLease = errors.New("an outstanding schema change lease exists")
+
+// SchemaChangerTestingKnobs allows tests to hook into the asynchronous
+// schema changer's execution.
+type SchemaChangerTestingKnobs struct {
+	// AsyncSchemaChangerExecNotification, if set, is invoked before the
+	// schema changer attempts to advance the mutation queue.
+	AsyncSchemaChangerExecNotification func()
+}
+
+// ModuleTestingKnobs implements the base.ModuleTestingKnobs interface.
+func (*SchemaChangerTestingKnobs) ModuleTestingKnobs() {}
+
+// SchemaChanger drives a single table's mutation queue (ADD COLUMN, CREATE
+// INDEX, DROP INDEX, ...) to completion. Only one SchemaChanger, on one
+// node, is meant to be actively processing a given table's mutations at a
+// time; AcquireLease/ExtendLease/ReleaseLease enforce that using an
+// {NodeID, ExpirationTime} pair CAS'd into the table descriptor itself.
+type SchemaChanger struct {
+	tableID      sqlbase.ID
+	nodeID       roachpb.NodeID
+	db           *client.DB
+	leaseMgr     *LeaseManager
+	testingKnobs *SchemaChangerTestingKnobs
+}
+
+// NewSchemaChanger creates a SchemaChanger for tableID that will run as
+// nodeID, writing through db and coordinating descriptor caching with
+// leaseMgr.
+func NewSchemaChanger(
+	tableID sqlbase.ID, nodeID roachpb.NodeID, db *client.DB, leaseMgr *LeaseManager,
+) SchemaChanger {
+	return SchemaChanger{
+		tableID:      tableID,
+		nodeID:       nodeID,
+		db:           db,
+		leaseMgr:     leaseMgr,
+		testingKnobs: &SchemaChangerTestingKnobs{},
+	}
+}
+
+// NewSchemaChangerForTesting builds a SchemaChanger wired up to knobs,
+// mirroring NewLeaseManager's testing constructor so that tests can drive
+// AcquireLease/ExtendLease/ReleaseLease directly without going through a
+// full schema-change statement.
+func NewSchemaChangerForTesting(
+	tableID sqlbase.ID,
+	nodeID roachpb.NodeID,
+	db *client.DB,
+	leaseMgr *LeaseManager,
+	knobs SchemaChangerTestingKnobs,
+) SchemaChanger {
+	sc := NewSchemaChanger(tableID, nodeID, db, leaseMgr)
+	sc.testingKnobs = &knobs
+	return sc
+}
+
+// AcquireLease CASes a fresh {NodeID, ExpirationTime} schema change lease
+// into the table descriptor, failing with errExistingSchemaChangeLease if
+// an unexpired lease held by another node (or another incarnation of this
+// one) is already present.
+func (sc *SchemaChanger) AcquireLease(
+	ctx context.Context,
+) (sqlbase.TableDescriptor_SchemaChangeLease, error) {
+	var lease sqlbase.TableDescriptor_SchemaChangeLease
+	err := sc.db.Txn(ctx, func(ctx context.Context, txn *client.Txn) error {
+		desc, err := sqlbase.GetTableDescFromID(ctx, txn, sc.tableID)
+		if err != nil {
+			return err
+		}
+		now := timeutil.Now().UnixNano()
+		if desc.HasSchemaChangeLease(now) {
+			return errExistingSchemaChangeLease
+		}
+		lease = sqlbase.TableDescriptor_SchemaChangeLease{
+			NodeID:         sc.nodeID,
+			ExpirationTime: now + schemaChangeLeaseDuration.Nanoseconds(),
+		}
+		desc.Lease = &lease
+		return sqlbase.WriteTableDesc(ctx, txn, desc)
+	})
+	return lease, err
+}
+
+// ExtendLease CASes a later ExpirationTime into the existing lease,
+// verifying that it's still held by sc.nodeID before extending it.
+func (sc *SchemaChanger) ExtendLease(
+	ctx context.Context, existing sqlbase.TableDescriptor_SchemaChangeLease,
+) (sqlbase.TableDescriptor_SchemaChangeLease, error) {
+	var lease sqlbase.TableDescriptor_SchemaChangeLease
+	err := sc.db.Txn(ctx, func(ctx context.Context, txn *client.Txn) error {
+		desc, err := sqlbase.GetTableDescFromID(ctx, txn, sc.tableID)
+		if err != nil {
+			return err
+		}
+		if desc.Lease == nil || *desc.Lease != existing {
+			return errExistingSchemaChangeLease
+		}
+		lease = sqlbase.TableDescriptor_SchemaChangeLease{
+			NodeID:         sc.nodeID,
+			ExpirationTime: timeutil.Now().UnixNano() + schemaChangeLeaseDuration.Nanoseconds(),
+		}
+		desc.Lease = &lease
+		return sqlbase.WriteTableDesc(ctx, txn, desc)
+	})
+	return lease, err
+}
+
+// ReleaseLease clears the schema change lease, provided it's still the one
+// we're holding; this lets a new schema changer (on any node) pick up the
+// mutation queue immediately instead of waiting out the expiration.
+func (sc *SchemaChanger) ReleaseLease(
+	ctx context.Context, existing sqlbase.TableDescriptor_SchemaChangeLease,
+) error {
+	return sc.db.Txn(ctx, func(ctx context.Context, txn *client.Txn) error {
+		desc, err := sqlbase.GetTableDescFromID(ctx, txn, sc.tableID)
+		if err != nil {
+			return err
+		}
+		if desc.Lease == nil || *desc.Lease != existing {
+			// Already released, extended by someone else, or expired and
+			// reclaimed; nothing for us to do.
+			return nil
+		}
+		desc.Lease = nil
+		return sqlbase.WriteTableDesc(ctx, txn, desc)
+	})
+}
+
+// runSchemaChange drives the table's mutation queue until it's empty,
+// bumping the descriptor's version through leaseMgr.Publish for every
+// mutation it completes so that AcquireByName callers on other nodes pick
+// up the change.
+func (sc *SchemaChanger) runSchemaChange(ctx context.Context) error {
+	if sc.testingKnobs.AsyncSchemaChangerExecNotification != nil {
+		sc.testingKnobs.AsyncSchemaChangerExecNotification()
+	}
+	lease, err := sc.AcquireLease(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if releaseErr := sc.ReleaseLease(ctx, lease); releaseErr != nil {
+			log.Warningf(ctx, "failed to release schema change lease: %s", releaseErr)
+		}
+	}()
+
+	for {
+		table, err := sc.leaseMgr.Publish(ctx, sc.tableID, func(desc *sqlbase.TableDescriptor) error {
+			return desc.ApplyNextMutation()
+		}, nil)
+		if err != nil {
+			return err
+		}
+		if len(table.Mutations) == 0 {
+			return nil
+		}
+	}
+}
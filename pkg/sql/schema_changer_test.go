@@ -0,0 +1,71 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package sql
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/testutils/serverutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+// TestSchemaChangeLease exercises the AcquireLease/ExtendLease/ReleaseLease
+// CAS cycle directly, the way the asynchronous schema changer drives it
+// while working through a table's mutation queue.
+func TestSchemaChangeLease(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	s, db, kvDB := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(context.TODO())
+
+	if _, err := db.Exec(`
+CREATE DATABASE t;
+CREATE TABLE t.test (k CHAR PRIMARY KEY, v CHAR);
+`); err != nil {
+		t.Fatal(err)
+	}
+
+	tableDesc := sqlbase.GetTableDescriptor(kvDB, "t", "test")
+	leaseMgr := s.LeaseManager().(*LeaseManager)
+	sc := NewSchemaChangerForTesting(tableDesc.ID, 1, kvDB, leaseMgr, SchemaChangerTestingKnobs{})
+
+	lease, err := sc.AcquireLease(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A second node can't acquire the lease while it's outstanding.
+	other := NewSchemaChangerForTesting(tableDesc.ID, 2, kvDB, leaseMgr, SchemaChangerTestingKnobs{})
+	if _, err := other.AcquireLease(context.TODO()); err != errExistingSchemaChangeLease {
+		t.Fatalf("expected errExistingSchemaChangeLease, got %v", err)
+	}
+
+	lease, err = sc.ExtendLease(context.TODO(), lease)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sc.ReleaseLease(context.TODO(), lease); err != nil {
+		t.Fatal(err)
+	}
+
+	// Now that the lease has been released, another node can acquire it.
+	if _, err := other.AcquireLease(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package sqlbase
+
+import (
+	"github.com/cockroachdb/cockroach/pkg/util/encoding"
+	"github.com/pkg/errors"
+)
+
+// DescriptorStatus describes where, in its lifecycle, a table element
+// (currently only indexes) sits: whether it's fully active, or still being
+// built/torn down via a mutation.
+type DescriptorStatus int
+
+const (
+	// DescriptorIncomplete means the element is present only as a mutation:
+	// either being added (not yet backfilled) or being dropped (not yet
+	// GC'd).
+	DescriptorIncomplete DescriptorStatus = iota
+	// DescriptorActive means the element is part of the current descriptor
+	// and not undergoing any mutation.
+	DescriptorActive
+)
+
+// MakeIndexKeyPrefix returns the key prefix used for the data of all rows
+// in the given index of the given table.
+func MakeIndexKeyPrefix(tableID ID, indexID IndexID) []byte {
+	var key []byte
+	key = encoding.EncodeUvarintAscending(key, uint64(tableID))
+	key = encoding.EncodeUvarintAscending(key, uint64(indexID))
+	return key
+}
+
+// FindIndexByName returns the index with the given name, along with whether
+// it's part of the active descriptor or still only reachable through a
+// mutation (DescriptorIncomplete). It returns an error if no index, active
+// or mutating, has that name.
+func (desc *TableDescriptor) FindIndexByName(name string) (IndexDescriptor, DescriptorStatus, error) {
+	if desc.PrimaryIndex.Name == name {
+		return desc.PrimaryIndex, DescriptorActive, nil
+	}
+	for _, idx := range desc.Indexes {
+		if idx.Name == name {
+			return idx, DescriptorActive, nil
+		}
+	}
+	for _, m := range desc.Mutations {
+		if idx := m.GetIndex(); idx != nil && idx.Name == name {
+			return *idx, DescriptorIncomplete, nil
+		}
+	}
+	return IndexDescriptor{}, DescriptorIncomplete, errors.Errorf("index %q does not exist", name)
+}
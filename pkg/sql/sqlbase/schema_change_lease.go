@@ -0,0 +1,37 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package sqlbase
+
+import (
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+)
+
+// TableDescriptor_SchemaChangeLease records which node is currently
+// executing the asynchronous portion of a schema change (draining the
+// mutation queue) for a table, and until when. It's stored inline on the
+// TableDescriptor so that acquiring it is just a compare-and-swap of the
+// descriptor through the usual KV write path, rather than a separate
+// lease table.
+type TableDescriptor_SchemaChangeLease struct {
+	NodeID         roachpb.NodeID
+	ExpirationTime int64
+}
+
+// HasSchemaChangeLease returns true if the table descriptor currently
+// records an unexpired schema change lease, as of now (a unix nanosecond
+// timestamp).
+func (desc *TableDescriptor) HasSchemaChangeLease(now int64) bool {
+	return desc.Lease != nil && desc.Lease.ExpirationTime > now
+}